@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration wraps time.Duration so it can be unmarshalled from YAML strings
+// like "10s" or "500ms".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Defaults holds the probe settings applied to every bookmark unless a Rule
+// overrides them.
+type Defaults struct {
+	Method          string            `yaml:"method,omitempty"`
+	Timeout         Duration          `yaml:"timeout,omitempty"`
+	ExpectedStatus  []int             `yaml:"expected_status,omitempty"`
+	Headers         map[string]string `yaml:"headers,omitempty"`
+	FollowRedirects *bool             `yaml:"follow_redirects,omitempty"`
+	VerifyTLS       *bool             `yaml:"verify_tls,omitempty"`
+	Proxy           string            `yaml:"proxy,omitempty"`
+}
+
+// Rule overrides Defaults for bookmarks it matches, either by glob pattern
+// against the URL (Match) or by exact tag (Tag). Match and Tag are mutually
+// exclusive; if both are set, Tag takes precedence.
+type Rule struct {
+	Match           string            `yaml:"match,omitempty"`
+	Tag             string            `yaml:"tag,omitempty"`
+	Method          string            `yaml:"method,omitempty"`
+	Timeout         Duration          `yaml:"timeout,omitempty"`
+	ExpectedStatus  []int             `yaml:"expected_status,omitempty"`
+	Headers         map[string]string `yaml:"headers,omitempty"`
+	FollowRedirects *bool             `yaml:"follow_redirects,omitempty"`
+	VerifyTLS       *bool             `yaml:"verify_tls,omitempty"`
+	Proxy           string            `yaml:"proxy,omitempty"`
+
+	// matchRe is compiled from Match once, by loadConfig, rather than on
+	// every call to matches.
+	matchRe *regexp.Regexp
+}
+
+// Config is the top-level shape of the -config YAML file.
+type Config struct {
+	Defaults Defaults `yaml:"defaults"`
+	Rules    []Rule   `yaml:"rules"`
+}
+
+// ProbeSettings is the fully resolved set of options to use for a single
+// bookmark, after merging Config.Defaults with the first matching Rule.
+type ProbeSettings struct {
+	Method          string
+	Timeout         time.Duration
+	ExpectedStatus  map[int]bool // nil means "treat any status as up"
+	Headers         map[string]string
+	FollowRedirects bool
+	VerifyTLS       bool
+	Proxy           string // empty means "use -proxy, if any"
+}
+
+// defaultProbeSettings is used when no -config file was given.
+func defaultProbeSettings() ProbeSettings {
+	return ProbeSettings{
+		Method:          "GET",
+		Timeout:         5 * time.Second,
+		FollowRedirects: true,
+		VerifyTLS:       true,
+	}
+}
+
+func loadConfig(configPath string) (*Config, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	for i, rule := range cfg.Rules {
+		if rule.Match == "" {
+			continue
+		}
+		re, err := regexp.Compile(urlGlobToRegexp(rule.Match))
+		if err != nil {
+			return nil, fmt.Errorf("invalid match pattern %q: %w", rule.Match, err)
+		}
+		cfg.Rules[i].matchRe = re
+	}
+	return &cfg, nil
+}
+
+// settingsFor resolves the probe settings for a bookmark, starting from
+// c.Defaults and applying the first Rule that matches url or tag.
+func (c *Config) settingsFor(url, tag string) ProbeSettings {
+	s := defaultProbeSettings()
+	if c.Defaults.Method != "" {
+		s.Method = c.Defaults.Method
+	}
+	if c.Defaults.Timeout != 0 {
+		s.Timeout = time.Duration(c.Defaults.Timeout)
+	}
+	if len(c.Defaults.ExpectedStatus) > 0 {
+		s.ExpectedStatus = statusSet(c.Defaults.ExpectedStatus)
+	}
+	if c.Defaults.Headers != nil {
+		s.Headers = c.Defaults.Headers
+	}
+	if c.Defaults.FollowRedirects != nil {
+		s.FollowRedirects = *c.Defaults.FollowRedirects
+	}
+	if c.Defaults.VerifyTLS != nil {
+		s.VerifyTLS = *c.Defaults.VerifyTLS
+	}
+	if c.Defaults.Proxy != "" {
+		s.Proxy = c.Defaults.Proxy
+	}
+
+	for _, rule := range c.Rules {
+		if !rule.matches(url, tag) {
+			continue
+		}
+		if rule.Method != "" {
+			s.Method = rule.Method
+		}
+		if rule.Timeout != 0 {
+			s.Timeout = time.Duration(rule.Timeout)
+		}
+		if len(rule.ExpectedStatus) > 0 {
+			s.ExpectedStatus = statusSet(rule.ExpectedStatus)
+		}
+		if rule.Headers != nil {
+			s.Headers = mergeHeaders(s.Headers, rule.Headers)
+		}
+		if rule.FollowRedirects != nil {
+			s.FollowRedirects = *rule.FollowRedirects
+		}
+		if rule.VerifyTLS != nil {
+			s.VerifyTLS = *rule.VerifyTLS
+		}
+		if rule.Proxy != "" {
+			s.Proxy = rule.Proxy
+		}
+		break
+	}
+
+	return s
+}
+
+func (r Rule) matches(url, tag string) bool {
+	if r.Tag != "" {
+		return r.Tag == tag
+	}
+	if r.matchRe != nil {
+		return r.matchRe.MatchString(url)
+	}
+	return false
+}
+
+// urlGlobToRegexp translates a glob pattern into an anchored regexp matching
+// the whole string, where "*" matches any run of characters (including "/")
+// and "?" matches a single character. path.Match treats "/" as a path
+// separator that "*" won't cross, which makes it a poor fit for matching
+// whole URLs such as "https://example.com/*" against
+// "https://example.com/a/b".
+func urlGlobToRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+func statusSet(codes []int) map[int]bool {
+	set := make(map[int]bool, len(codes))
+	for _, c := range codes {
+		set[c] = true
+	}
+	return set
+}
+
+func mergeHeaders(base, override map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+	return merged
+}
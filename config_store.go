@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConfigStore holds the current Config and atomically swaps it in on
+// reload, so in-flight readers never observe a partially-loaded config.
+type ConfigStore struct {
+	path        string
+	mu          sync.RWMutex
+	cfg         *Config
+	reloadTotal *prometheus.CounterVec
+}
+
+func NewConfigStore(path string, reloadTotal *prometheus.CounterVec) (*ConfigStore, error) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigStore{path: path, cfg: cfg, reloadTotal: reloadTotal}, nil
+}
+
+func (s *ConfigStore) Get() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+func (s *ConfigStore) reload() {
+	cfg, err := loadConfig(s.path)
+	if err != nil {
+		log.Printf("Error reloading config %s: %v", s.path, err)
+		s.reloadTotal.WithLabelValues("error").Inc()
+		return
+	}
+
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+
+	s.reloadTotal.WithLabelValues("success").Inc()
+	log.Printf("Reloaded config from %s", s.path)
+}
+
+// watch blocks, reloading the config on every write/create event for path,
+// until ctx is cancelled. Watching the containing directory, rather than the
+// file itself, survives editors that replace the file via rename.
+func (s *ConfigStore) watch(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Error creating config watcher: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	dir := filepath.Dir(s.path)
+	if err := watcher.Add(dir); err != nil {
+		log.Printf("Error watching config directory %s: %v", dir, err)
+		return
+	}
+
+	target := filepath.Clean(s.path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != target {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			s.reload()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Config watcher error: %v", err)
+		}
+	}
+}
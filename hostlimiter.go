@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// hostLimiter bounds per-host concurrency and, once a host returns a 429 or
+// 503 with a Retry-After header, defers further probes of that host until
+// the backoff elapses.
+type hostLimiter struct {
+	perHost int
+
+	mu        sync.Mutex
+	sems      map[string]chan struct{}
+	throttled map[string]time.Time
+
+	inflight *prometheus.GaugeVec
+	throttle *prometheus.GaugeVec
+}
+
+func newHostLimiter(perHost int, inflight, throttle *prometheus.GaugeVec) *hostLimiter {
+	return &hostLimiter{
+		perHost:   perHost,
+		sems:      make(map[string]chan struct{}),
+		throttled: make(map[string]time.Time),
+		inflight:  inflight,
+		throttle:  throttle,
+	}
+}
+
+// readyAt returns the time at which host may next be probed, or the zero
+// time if it isn't currently throttled.
+func (h *hostLimiter) readyAt(host string) time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	until, ok := h.throttled[host]
+	if !ok {
+		return time.Time{}
+	}
+	if !time.Now().Before(until) {
+		delete(h.throttled, host)
+		h.throttle.WithLabelValues(host).Set(0)
+		return time.Time{}
+	}
+	return until
+}
+
+// setThrottled defers probes of host until until.
+func (h *hostLimiter) setThrottled(host string, until time.Time) {
+	h.mu.Lock()
+	h.throttled[host] = until
+	h.mu.Unlock()
+	h.throttle.WithLabelValues(host).Set(1)
+}
+
+// acquire blocks until a per-host slot is free (or ctx is cancelled),
+// tracking bookmarks_alive_host_inflight. The returned func releases the
+// slot and must be called exactly once.
+func (h *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	h.mu.Lock()
+	sem, ok := h.sems[host]
+	if !ok {
+		sem = make(chan struct{}, h.perHost)
+		h.sems[host] = sem
+	}
+	h.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	h.inflight.WithLabelValues(host).Inc()
+	return func() {
+		h.inflight.WithLabelValues(host).Dec()
+		<-sem
+	}, nil
+}
+
+// hostOf extracts the host:port a bookmark URL would be dialed on, falling
+// back to the raw URL if it doesn't parse.
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return u.Host
+}
+
+// parseRetryAfter interprets an HTTP Retry-After header value, either a
+// number of seconds or an HTTP-date, returning the remaining wait duration.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+	}
+	return 0, false
+}
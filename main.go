@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"sync"
@@ -18,142 +23,532 @@ import (
 )
 
 var (
-	urlStatus = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "bookmarks_alive_status",
-			Help: "HTTP status code of the bookmarked URL",
-		},
-		[]string{"url"},
-	)
 	db          *sql.DB
-	metricsChan chan metricUpdate
+	collector   *BookmarksCollector
+	configStore *ConfigStore // nil when no -config flag was given
 	userAgent   string
+	hasTagCol   bool
+	globalProxy string // from -proxy; used when a bookmark has no proxy of its own
+	limiter     *hostLimiter
 )
 
-type metricUpdate struct {
-	url    string
-	status float64
+// bookmark is a single row read from the bookmarks table.
+type bookmark struct {
+	url string
+	tag string
 }
 
-func init() {
-	prometheus.MustRegister(urlStatus)
+// probeOutcome holds everything observed from a single probe of a URL.
+type probeOutcome struct {
+	statusCode float64
+	up         float64
+	duration   float64
+	certExpiry float64 // unix seconds; 0 if the connection wasn't TLS
+	redirects  float64
+	errReason  string        // dns, timeout, tls, connect, read; empty on success
+	proxy      string        // proxy URL used for this probe, if any
+	retryAfter time.Duration // from a 429/503 Retry-After header; 0 if absent
 }
 
-func checkURL(ctx context.Context, url string) float64 {
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+// BookmarksCollector implements prometheus.Collector, grouping every metric
+// produced by probing bookmarks so they can be registered and described as a
+// single unit.
+type BookmarksCollector struct {
+	status        *prometheus.GaugeVec
+	up            *prometheus.GaugeVec
+	duration      *prometheus.HistogramVec
+	probeErrors   *prometheus.CounterVec
+	sslExpiry     *prometheus.GaugeVec
+	redirects     *prometheus.GaugeVec
+	configReload  *prometheus.CounterVec
+	trackedURLs   prometheus.Gauge
+	pruned        prometheus.Counter
+	proxyErrors   *prometheus.CounterVec
+	hostInflight  *prometheus.GaugeVec
+	hostThrottled *prometheus.GaugeVec
+}
+
+func NewBookmarksCollector() *BookmarksCollector {
+	return &BookmarksCollector{
+		status: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "bookmarks_alive_status",
+				Help: "HTTP status code of the bookmarked URL",
+			},
+			[]string{"url"},
+		),
+		up: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "bookmarks_alive_up",
+				Help: "Whether the last probe of the bookmarked URL reached the server (1) or failed outright (0)",
+			},
+			[]string{"url"},
+		),
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "bookmarks_alive_duration_seconds",
+				Help:    "Duration of the probe request in seconds",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"url"},
+		),
+		probeErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "bookmarks_alive_probe_errors_total",
+				Help: "Total number of probe errors by reason",
+			},
+			[]string{"url", "reason"},
+		),
+		sslExpiry: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "bookmarks_alive_ssl_cert_expiry_seconds",
+				Help: "Unix timestamp of the TLS certificate's NotAfter for the bookmarked URL",
+			},
+			[]string{"url"},
+		),
+		redirects: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "bookmarks_alive_redirects",
+				Help: "Number of redirects followed on the last probe of the bookmarked URL",
+			},
+			[]string{"url"},
+		),
+		configReload: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "bookmarks_alive_config_reload_total",
+				Help: "Total number of config file (re)loads by result",
+			},
+			[]string{"result"},
+		),
+		trackedURLs: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "bookmarks_alive_tracked_urls",
+				Help: "Number of distinct bookmark URLs seen in the most recent probe cycle",
+			},
+		),
+		pruned: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "bookmarks_alive_pruned_total",
+				Help: "Total number of stale bookmark label series removed because the URL left the database",
+			},
+		),
+		proxyErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "bookmarks_alive_proxy_errors_total",
+				Help: "Total number of probe errors for URLs routed through a proxy, by proxy and reason",
+			},
+			[]string{"proxy", "reason"},
+		),
+		hostInflight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "bookmarks_alive_host_inflight",
+				Help: "Number of probes currently in flight against a destination host",
+			},
+			[]string{"host"},
+		),
+		hostThrottled: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "bookmarks_alive_host_throttled",
+				Help: "Whether a destination host is currently backed off after a 429/503 Retry-After",
+			},
+			[]string{"host"},
+		),
+	}
+}
+
+func (c *BookmarksCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.status.Describe(ch)
+	c.up.Describe(ch)
+	c.duration.Describe(ch)
+	c.probeErrors.Describe(ch)
+	c.sslExpiry.Describe(ch)
+	c.redirects.Describe(ch)
+	c.configReload.Describe(ch)
+	c.trackedURLs.Describe(ch)
+	c.pruned.Describe(ch)
+	c.proxyErrors.Describe(ch)
+	c.hostInflight.Describe(ch)
+	c.hostThrottled.Describe(ch)
+}
+
+func (c *BookmarksCollector) Collect(ch chan<- prometheus.Metric) {
+	c.status.Collect(ch)
+	c.up.Collect(ch)
+	c.duration.Collect(ch)
+	c.probeErrors.Collect(ch)
+	c.sslExpiry.Collect(ch)
+	c.redirects.Collect(ch)
+	c.configReload.Collect(ch)
+	c.trackedURLs.Collect(ch)
+	c.pruned.Collect(ch)
+	c.proxyErrors.Collect(ch)
+	c.hostInflight.Collect(ch)
+	c.hostThrottled.Collect(ch)
+}
+
+// record applies a single probe outcome to the underlying metric vectors.
+func (c *BookmarksCollector) record(url string, o probeOutcome) {
+	c.status.WithLabelValues(url).Set(o.statusCode)
+	c.up.WithLabelValues(url).Set(o.up)
+	c.duration.WithLabelValues(url).Observe(o.duration)
+	c.redirects.WithLabelValues(url).Set(o.redirects)
+	if o.certExpiry > 0 {
+		c.sslExpiry.WithLabelValues(url).Set(o.certExpiry)
+	}
+	if o.errReason != "" {
+		c.probeErrors.WithLabelValues(url, o.errReason).Inc()
+		if o.proxy != "" {
+			c.proxyErrors.WithLabelValues(o.proxy, o.errReason).Inc()
+		}
+	}
+}
+
+// prune deletes every label series belonging to urls, the set of bookmarks
+// that disappeared from the database since the previous probe cycle.
+func (c *BookmarksCollector) prune(urls []string) {
+	for _, url := range urls {
+		c.status.DeleteLabelValues(url)
+		c.up.DeleteLabelValues(url)
+		c.duration.DeleteLabelValues(url)
+		c.sslExpiry.DeleteLabelValues(url)
+		c.redirects.DeleteLabelValues(url)
+		c.probeErrors.DeletePartialMatch(prometheus.Labels{"url": url})
+	}
+	c.pruned.Add(float64(len(urls)))
+}
+
+func (c *BookmarksCollector) setTrackedURLs(n int) {
+	c.trackedURLs.Set(float64(n))
+}
+
+// classifyError buckets a probe error into one of a small set of reasons
+// suitable for the probe_errors_total counter's "reason" label.
+func classifyError(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &certErr) || errors.As(err, &recordErr) {
+		return "tls"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "read" {
+		return "read"
+	}
+
+	return "connect"
+}
+
+// settingsFor resolves the ProbeSettings for a bookmark, falling back to
+// defaultProbeSettings() when no -config file is in use. A Proxy left unset
+// by the config falls back to the global -proxy flag.
+func settingsFor(b bookmark) ProbeSettings {
+	s := defaultProbeSettings()
+	if configStore != nil {
+		s = configStore.Get().settingsFor(b.url, b.tag)
+	}
+	if s.Proxy == "" {
+		s.Proxy = globalProxy
+	}
+	return s
+}
+
+var (
+	transportCacheMu sync.Mutex
+	transportCache   = map[transportKey]*http.Transport{}
+)
+
+// transportKey identifies the http.Transport properties that affect
+// connection pooling, so probes sharing them reuse the same pool instead of
+// dialing fresh connections every cycle.
+type transportKey struct {
+	proxy     string
+	verifyTLS bool
+}
+
+// transportFor returns a cached *http.Transport for the given proxy/TLS
+// combination, creating and caching one on first use. Transports are safe
+// for concurrent use, so every probe for a given key shares one connection
+// pool regardless of how many workers are probing concurrently.
+func transportFor(settings ProbeSettings) (*http.Transport, error) {
+	key := transportKey{proxy: settings.Proxy, verifyTLS: settings.VerifyTLS}
+
+	transportCacheMu.Lock()
+	defer transportCacheMu.Unlock()
+	if t, ok := transportCache[key]; ok {
+		return t, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if settings.Proxy != "" {
+		proxyURL, err := url.Parse(settings.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q: %w", settings.Proxy, err)
+		}
+		// http.ProxyURL understands http(s):// and socks5:// schemes.
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if !settings.VerifyTLS {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	transportCache[key] = transport
+	return transport, nil
+}
+
+func checkURL(ctx context.Context, b bookmark, settings ProbeSettings) probeOutcome {
+	transport, err := transportFor(settings)
+	if err != nil {
+		log.Printf("Error building transport for URL %s: %v", b.url, err)
+		return probeOutcome{errReason: "connect", proxy: settings.Proxy}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, settings.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, settings.Method, b.url, nil)
 	if err != nil {
-		log.Printf("Error creating request for URL %s: %v", url, err)
-		return 0
+		log.Printf("Error creating request for URL %s: %v", b.url, err)
+		return probeOutcome{errReason: "connect", proxy: settings.Proxy}
 	}
 	req.Header.Set("User-Agent", userAgent)
+	for k, v := range settings.Headers {
+		req.Header.Set(k, v)
+	}
 
-	client := &http.Client{
-		Timeout: 5 * time.Second,
+	client := &http.Client{Transport: transport}
+	if !settings.FollowRedirects {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
 	}
+
+	start := time.Now()
 	resp, err := client.Do(req)
+	duration := time.Since(start).Seconds()
 	if err != nil {
-		log.Printf("Error checking URL %s: %v", url, err)
-		return 0
+		log.Printf("Error checking URL %s: %v", b.url, err)
+		return probeOutcome{duration: duration, errReason: classifyError(err), proxy: settings.Proxy}
 	}
 	defer resp.Body.Close()
-	return float64(resp.StatusCode)
+
+	outcome := probeOutcome{
+		statusCode: float64(resp.StatusCode),
+		up:         1,
+		duration:   duration,
+		proxy:      settings.Proxy,
+	}
+	if settings.ExpectedStatus != nil && !settings.ExpectedStatus[resp.StatusCode] {
+		outcome.up = 0
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			outcome.retryAfter = d
+		}
+	}
+
+	for r := resp.Request.Response; r != nil; r = r.Request.Response {
+		outcome.redirects++
+	}
+
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		outcome.certExpiry = float64(resp.TLS.PeerCertificates[0].NotAfter.Unix())
+	}
+
+	return outcome
 }
 
-func urlChecker(ctx context.Context, urls <-chan string, updates chan<- metricUpdate, wg *sync.WaitGroup) {
+// urlChecker probes bookmarks until the channel closes or ctx is cancelled,
+// recording each outcome straight into collector. GaugeVec/HistogramVec/
+// CounterVec are safe for concurrent use, so workers never need to hand
+// results back through an intermediate channel.
+func urlChecker(ctx context.Context, bookmarks <-chan bookmark, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case url, ok := <-urls:
+		case b, ok := <-bookmarks:
 			if !ok {
 				return
 			}
-			status := checkURL(ctx, url)
-			select {
-			case <-ctx.Done():
+
+			host := hostOf(b.url)
+			if until := limiter.readyAt(host); !until.IsZero() {
+				log.Printf("Skipping %s: host %s throttled until %s", b.url, host, until.Format(time.RFC3339))
+				continue
+			}
+
+			release, err := limiter.acquire(ctx, host)
+			if err != nil {
 				return
-			case updates <- metricUpdate{url: url, status: status}:
 			}
+			outcome := checkURL(ctx, b, settingsFor(b))
+			release()
+
+			if outcome.retryAfter > 0 {
+				limiter.setThrottled(host, time.Now().Add(outcome.retryAfter))
+			}
+
+			collector.record(b.url, outcome)
 		}
 	}
 }
 
-func collectMetrics(ctx context.Context) error {
-	rows, err := db.QueryContext(ctx, "SELECT url FROM bookmarks")
+// collectMetrics probes every bookmark currently in the database and
+// returns the set of URLs it saw, so the caller can detect ones that were
+// removed since the previous cycle.
+func collectMetrics(ctx context.Context, maxConcurrency int) ([]string, error) {
+	query := "SELECT url FROM bookmarks"
+	if hasTagCol {
+		query = "SELECT url, tag FROM bookmarks"
+	}
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rows.Close()
 
-	urlChan := make(chan string, 100)
+	bookmarkChan := make(chan bookmark, 100)
 	var wg sync.WaitGroup
 
-	workerCount := 20
-	for i := 0; i < workerCount; i++ {
+	for i := 0; i < maxConcurrency; i++ {
 		wg.Add(1)
-		go urlChecker(ctx, urlChan, metricsChan, &wg)
+		go urlChecker(ctx, bookmarkChan, &wg)
 	}
 
+	var urls []string
 	go func() {
-		defer close(urlChan)
+		defer close(bookmarkChan)
 		for rows.Next() {
-			var url string
-			if err := rows.Scan(&url); err != nil {
-				log.Printf("Error scanning row: %v", err)
+			var b bookmark
+			var scanErr error
+			if hasTagCol {
+				var tag sql.NullString
+				scanErr = rows.Scan(&b.url, &tag)
+				b.tag = tag.String
+			} else {
+				scanErr = rows.Scan(&b.url)
+			}
+			if scanErr != nil {
+				log.Printf("Error scanning row: %v", scanErr)
 				continue
 			}
+			urls = append(urls, b.url)
 			select {
 			case <-ctx.Done():
 				return
-			case urlChan <- url:
+			case bookmarkChan <- b:
 			}
 		}
 	}()
 
+	// wg.Wait only returns once bookmarkChan is closed, which happens after
+	// the goroutine above finishes appending to urls, so this read is safe.
 	wg.Wait()
-	return nil
+	return urls, rows.Err()
 }
 
-func updateMetrics(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
+// probeLoop runs the probe cycle immediately and then on every tick of
+// interval, until ctx is cancelled.
+func probeLoop(ctx context.Context, interval time.Duration, maxConcurrency int, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	seen := make(map[string]struct{})
+
+	runCycle := func() {
+		urls, err := collectMetrics(ctx, maxConcurrency)
+		if err != nil {
+			log.Printf("Error collecting metrics: %v", err)
 			return
-		case update, ok := <-metricsChan:
-			if !ok {
-				return
+		}
+
+		current := make(map[string]struct{}, len(urls))
+		for _, url := range urls {
+			current[url] = struct{}{}
+		}
+
+		var stale []string
+		for url := range seen {
+			if _, ok := current[url]; !ok {
+				stale = append(stale, url)
 			}
-			urlStatus.WithLabelValues(update.url).Set(update.status)
-		default:
-			return // Exit when channel is empty
 		}
+		if len(stale) > 0 {
+			collector.prune(stale)
+			log.Printf("Pruned %d stale bookmark label series", len(stale))
+		}
+		collector.setTrackedURLs(len(current))
+		seen = current
 	}
-}
 
-func metricsHandler() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
-		defer cancel()
+	runCycle()
 
-		if err := collectMetrics(ctx); err != nil {
-			log.Printf("Error collecting metrics: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-ticker.C:
+			runCycle()
 		}
+	}
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
 
-		updateMetrics(ctx)
+// detectTagColumn reports whether the bookmarks table has a "tag" column,
+// used to classify bookmarks for per-tag config rules.
+func detectTagColumn(db *sql.DB) (bool, error) {
+	rows, err := db.Query("PRAGMA table_info(bookmarks)")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
 
-		promhttp.Handler().ServeHTTP(w, r)
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notnull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == "tag" {
+			return true, nil
+		}
 	}
+	return false, rows.Err()
 }
 
 func main() {
 	dbPath := flag.String("db", "./bookmarks.db", "Path to SQLite database")
 	port := flag.String("port", "8000", "Port to serve metrics on")
+	interval := flag.Duration("interval", 5*time.Minute, "Interval between background probe cycles")
+	configPath := flag.String("config", "", "Path to optional YAML config file for per-URL/per-tag probe overrides")
+	maxConcurrency := flag.Int("max-concurrency", 20, "Maximum number of probes in flight at once, across all hosts")
+	hostConcurrency := flag.Int("host-concurrency", 2, "Maximum number of probes in flight at once against a single destination host")
 	flag.StringVar(&userAgent, "user-agent", "bookmarks-alive-exporter/1.0", "User Agent string to use for HTTP requests")
+	flag.StringVar(&globalProxy, "proxy", "", "Default HTTP/SOCKS5 proxy URL to route probes through (overridden by per-URL config)")
 	flag.Parse()
 
+	collector = NewBookmarksCollector()
+	prometheus.MustRegister(collector)
+	limiter = newHostLimiter(*hostConcurrency, collector.hostInflight, collector.hostThrottled)
+
 	var err error
 	db, err = sql.Open("sqlite3", *dbPath)
 	if err != nil {
@@ -165,11 +560,29 @@ func main() {
 		log.Fatalf("Error connecting to database: %v", err)
 	}
 
-	metricsChan = make(chan metricUpdate, 1000)
+	if hasTagCol, err = detectTagColumn(db); err != nil {
+		log.Fatalf("Error inspecting bookmarks table: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *configPath != "" {
+		configStore, err = NewConfigStore(*configPath, collector.configReload)
+		if err != nil {
+			log.Fatalf("Error loading config %s: %v", *configPath, err)
+		}
+		go configStore.watch(ctx)
+	}
+
+	var probeWG sync.WaitGroup
+	probeWG.Add(1)
+	go probeLoop(ctx, *interval, *maxConcurrency, &probeWG)
 
 	http.Handle("/metrics", metricsHandler())
 	log.Printf("Starting bookmarks-alive-exporter on :%s", *port)
 	log.Printf("Using User-Agent: %s", userAgent)
+	log.Printf("Probe interval: %s", *interval)
 
 	server := &http.Server{
 		Addr:    ":" + *port,
@@ -183,14 +596,16 @@ func main() {
 	}()
 
 	// Wait for interrupt signal to gracefully shutdown the server
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	<-stop
+	<-ctx.Done()
 
 	log.Println("Shutting down server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	// Let any in-flight probe cycle finish before the process exits.
+	probeWG.Wait()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
+	if err := server.Shutdown(shutdownCtx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 